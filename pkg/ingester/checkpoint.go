@@ -0,0 +1,364 @@
+package ingester
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/cortex/pkg/prom1/storage/local/chunk"
+)
+
+const checkpointDirPrefix = "checkpoint."
+
+// checkpointedChunk is the on-disk representation of a desc: the chunk
+// bytes plus the bookkeeping fields needed to reconstruct it without
+// re-deriving them from the chunk's contents.
+type checkpointedChunk struct {
+	FirstTime  model.Time
+	LastTime   model.Time
+	LastUpdate model.Time
+	Encoding   byte
+	Data       []byte
+}
+
+// checkpointedSeries is the on-disk representation of a memorySeries. It
+// covers the fpToSeries map and each series' chunkDescs, but not its
+// exemplar buffer or out-of-order state (s.ooo, s.oooChunkDescs): those are
+// dropped on every restart rather than round-tripped through the
+// checkpoint. Series recreated from a checkpoint get fresh, empty versions
+// of both (see loadCheckpoint), so a restart silently loses any buffered
+// exemplars and any accepted-but-not-yet-flushed out-of-order chunks.
+type checkpointedSeries struct {
+	Fingerprint     model.Fingerprint
+	Metric          model.Metric
+	Chunks          []checkpointedChunk
+	HeadChunkClosed bool
+	LastTime        model.Time
+}
+
+// checkpointSeriesMapAndHeads snapshots every series in states to a new
+// checkpoint directory under dir, named after the WAL segment that was
+// active when the snapshot was taken (so replay knows where to resume the
+// WAL from). It is analogous to Prometheus 1.x's
+// checkpointSeriesMapAndHeads. See checkpointedSeries for what is and isn't
+// captured.
+func checkpointSeriesMapAndHeads(dir string, walSegment int, states *fingerprintSeriesMap) error {
+	tmp := filepath.Join(dir, checkpointDirPrefix+"tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(tmp, "series"))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+
+	var encodeErr error
+	states.forEach(func(fp model.Fingerprint, s *memorySeries) bool {
+		cs := checkpointedSeries{
+			Fingerprint:     fp,
+			Metric:          s.metric,
+			HeadChunkClosed: s.headChunkClosed,
+			LastTime:        s.lastTime,
+		}
+		for _, d := range s.chunkDescs {
+			// The evictor may have nil'd out d.C since we last looked at
+			// this series. Pin it so it can't be evicted out from under
+			// us while we marshal it; a still-evicted chunk is skipped
+			// rather than reloaded, since it is already durable in the
+			// chunk store and will be picked up again there on query.
+			d.pin()
+			cc, ok, chunkErr := checkpointChunk(d)
+			d.unpin()
+			if chunkErr != nil {
+				encodeErr = chunkErr
+				return false
+			}
+			if ok {
+				cs.Chunks = append(cs.Chunks, cc)
+			}
+		}
+		encodeErr = enc.Encode(&cs)
+		return encodeErr == nil
+	})
+	if encodeErr != nil {
+		f.Close()
+		return encodeErr
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	final := checkpointDir(dir, walSegment)
+	if err := os.RemoveAll(final); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		return err
+	}
+	return removeOldCheckpoints(dir, final)
+}
+
+// checkpointChunk marshals d's chunk for the checkpoint, under a pin held
+// by the caller. ok is false, with no error, if d was evicted and thus has
+// nothing to marshal.
+func checkpointChunk(d *desc) (cc checkpointedChunk, ok bool, err error) {
+	if d.isEvicted() {
+		return checkpointedChunk{}, false, nil
+	}
+	var buf bytes.Buffer
+	if err := d.C.Marshal(&buf); err != nil {
+		return checkpointedChunk{}, false, err
+	}
+	return checkpointedChunk{
+		FirstTime:  d.FirstTime,
+		LastTime:   d.LastTime,
+		LastUpdate: d.LastUpdate,
+		Encoding:   byte(d.C.Encoding()),
+		Data:       buf.Bytes(),
+	}, true, nil
+}
+
+func checkpointDir(dir string, walSegment int) string {
+	return filepath.Join(dir, checkpointDirPrefix+segmentName(walSegment))
+}
+
+func removeOldCheckpoints(dir, keep string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == filepath.Base(keep) {
+			continue
+		}
+		if len(e.Name()) < len(checkpointDirPrefix) || e.Name()[:len(checkpointDirPrefix)] != checkpointDirPrefix {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastCheckpoint returns the newest checkpoint directory under dir and the
+// WAL segment number it was named after, or ok=false if there is none.
+func lastCheckpoint(dir string) (path string, walSegment int, ok bool, err error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	best := -1
+	for _, e := range entries {
+		if !e.IsDir() || len(e.Name()) <= len(checkpointDirPrefix) {
+			continue
+		}
+		name := e.Name()[:len(checkpointDirPrefix)]
+		if name != checkpointDirPrefix {
+			continue
+		}
+		n, err := parseSegmentSuffix(e.Name()[len(checkpointDirPrefix):])
+		if err != nil {
+			continue
+		}
+		if n > best {
+			best = n
+		}
+	}
+	if best < 0 {
+		return "", 0, false, nil
+	}
+	return checkpointDir(dir, best), best, true, nil
+}
+
+func parseSegmentSuffix(s string) (int, error) {
+	var n int
+	_, err := fmt.Sscanf(s, "%d", &n)
+	return n, err
+}
+
+// loadCheckpoint reads the newest checkpoint directory under dir into a
+// fresh fingerprintSeriesMap, recreating each series with defaults for the
+// limits that aren't themselves part of the checkpoint. It returns the WAL
+// segment the checkpoint was taken at, so the caller knows where to resume
+// WAL replay from. Every recreated series starts with an empty exemplar
+// buffer and no out-of-order state, since neither is part of
+// checkpointedSeries.
+func loadCheckpoint(dir string, defaults SeriesDefaults) (*fingerprintSeriesMap, int, error) {
+	path, walSegment, ok, err := lastCheckpoint(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	states := newFingerprintSeriesMap()
+	if !ok {
+		return states, 0, nil
+	}
+
+	f, err := os.Open(filepath.Join(path, "series"))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		var cs checkpointedSeries
+		if err := dec.Decode(&cs); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		series := newMemorySeries(cs.Metric, defaults.MaxExemplars, defaults.OOOWindow)
+		descs := make([]*desc, 0, len(cs.Chunks))
+		for _, c := range cs.Chunks {
+			chk, err := chunk.NewForEncoding(chunk.Encoding(c.Encoding))
+			if err != nil {
+				return nil, 0, err
+			}
+			if err := chk.UnmarshalFromBuf(c.Data); err != nil {
+				return nil, 0, err
+			}
+			d := newDesc(chk, c.FirstTime, c.LastTime)
+			d.LastUpdate = c.LastUpdate
+			descs = append(descs, d)
+		}
+		if err := series.setChunks(descs); err != nil {
+			return nil, 0, err
+		}
+		series.headChunkClosed = cs.HeadChunkClosed
+		// cs.LastTime is unconditionally populated by
+		// checkpointSeriesMapAndHeads from s.lastTime, which is never
+		// itself "unset" (newMemorySeries starts it at model.Earliest, not
+		// 0) — so it's always authoritative and must win over whatever
+		// setChunks derived from the restored descs, including when there
+		// are none. model.Time(0) is a legitimate timestamp (the Unix
+		// epoch), so it must never be treated as a "not set" sentinel here.
+		series.lastTime = cs.LastTime
+		states.set(cs.Fingerprint, series)
+	}
+
+	log.Infof("loaded checkpoint %s with %d series", path, states.len())
+	return states, walSegment, nil
+}
+
+// checkpointer periodically snapshots states to disk and truncates WAL
+// segments the snapshot has made redundant.
+type checkpointer struct {
+	cfg    WALConfig
+	wal    *WAL
+	states *fingerprintSeriesMap
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newCheckpointer(cfg WALConfig, wal *WAL, states *fingerprintSeriesMap) *checkpointer {
+	return &checkpointer{
+		cfg:    cfg,
+		wal:    wal,
+		states: states,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// run fires a checkpoint on cfg.CheckpointInterval, or as soon as the WAL's
+// dirty-series count crosses cfg.CheckpointDirtySeriesThreshold, whichever
+// comes first.
+func (c *checkpointer) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.cfg.CheckpointInterval)
+	defer ticker.Stop()
+
+	dirtyCheck := time.NewTicker(time.Second)
+	defer dirtyCheck.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.checkpoint()
+		case <-dirtyCheck.C:
+			if c.wal.dirtyExceeds(c.cfg.CheckpointDirtySeriesThreshold) {
+				c.checkpoint()
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *checkpointer) checkpoint() {
+	// Cut a fresh segment before snapshotting so the checkpoint can be
+	// labeled with a segment that holds only samples appended after this
+	// point; otherwise replay would redo everything already in the
+	// segment that was active while we took the snapshot.
+	segment, err := c.wal.rotate()
+	if err != nil {
+		log.Errorf("wal: rotate failed: %v", err)
+		return
+	}
+	if err := checkpointSeriesMapAndHeads(c.cfg.Dir, segment, c.states); err != nil {
+		log.Errorf("wal: checkpoint failed: %v", err)
+		return
+	}
+	if err := c.wal.truncate(segment); err != nil {
+		log.Errorf("wal: truncate after checkpoint failed: %v", err)
+	}
+	c.wal.resetDirty(segment)
+}
+
+func (c *checkpointer) stop() {
+	close(c.quit)
+	<-c.done
+	c.checkpoint()
+}
+
+// recoverFromWAL rebuilds in-memory state from cfg.Dir: it loads the newest
+// checkpoint (if any), replays the WAL segments written after it, and opens
+// a fresh WAL segment for subsequent appends. Restored series are created
+// with the per-series limits in defaults. New() does not call it, so the
+// ingester does not restore this state on startup. If
+// cfg.Dir is empty the WAL is disabled and recoverFromWAL returns an empty
+// map and a nil *WAL.
+func recoverFromWAL(cfg WALConfig, defaults SeriesDefaults) (*fingerprintSeriesMap, *WAL, error) {
+	if cfg.Dir == "" {
+		return newFingerprintSeriesMap(), nil, nil
+	}
+
+	states, walSegment, err := loadCheckpoint(cfg.Dir, defaults)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := replayWAL(cfg.Dir, walSegment, states, defaults); err != nil {
+		return nil, nil, err
+	}
+
+	wal, err := newWAL(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return states, wal, nil
+}
@@ -0,0 +1,104 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	states := newFingerprintSeriesMap()
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 0)
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 1, Value: 1}))
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 2, Value: 2}))
+	s.closeHead()
+	fp := model.Fingerprint(42)
+	states.set(fp, s)
+
+	require.NoError(t, checkpointSeriesMapAndHeads(dir, 3, states))
+
+	defaults := SeriesDefaults{MaxExemplars: 5, OOOWindow: time.Minute}
+	loaded, walSegment, err := loadCheckpoint(dir, defaults)
+	require.NoError(t, err)
+	assert.Equal(t, 3, walSegment)
+
+	restored, ok := loaded.get(fp)
+	require.True(t, ok)
+	assert.Equal(t, s.metric, restored.metric)
+	assert.Equal(t, defaults.OOOWindow, restored.oooWindow)
+	assert.Equal(t, defaults.MaxExemplars, len(restored.exemplars.buf))
+
+	values, err := valuesForRange(restored.chunkDescs, model.Earliest, model.Latest, nil)
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	assert.Equal(t, model.Time(1), values[0].Timestamp)
+	assert.Equal(t, model.Time(2), values[1].Timestamp)
+}
+
+func TestCheckpointSkipsEvictedChunks(t *testing.T) {
+	dir := t.TempDir()
+
+	states := newFingerprintSeriesMap()
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 0)
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 1, Value: 1}))
+	s.closeHead()
+	s.head().markFlushed()
+	require.True(t, s.head().evict())
+
+	fp := model.Fingerprint(1)
+	states.set(fp, s)
+
+	require.NoError(t, checkpointSeriesMapAndHeads(dir, 0, states))
+
+	loaded, _, err := loadCheckpoint(dir, SeriesDefaults{})
+	require.NoError(t, err)
+
+	restored, ok := loaded.get(fp)
+	require.True(t, ok)
+	assert.Empty(t, restored.chunkDescs)
+}
+
+func TestCheckpointRestoresLastTimeOfZero(t *testing.T) {
+	dir := t.TempDir()
+
+	states := newFingerprintSeriesMap()
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 0)
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 0, Value: 1}))
+	s.closeHead()
+	s.head().markFlushed()
+	require.True(t, s.head().evict())
+
+	fp := model.Fingerprint(1)
+	states.set(fp, s)
+
+	require.NoError(t, checkpointSeriesMapAndHeads(dir, 0, states))
+
+	loaded, _, err := loadCheckpoint(dir, SeriesDefaults{})
+	require.NoError(t, err)
+
+	restored, ok := loaded.get(fp)
+	require.True(t, ok)
+	// model.Time(0) is a legitimate last-sample time, not a "not set"
+	// sentinel, and must survive restore even though the series has no
+	// surviving chunks to derive it from.
+	assert.Equal(t, model.Time(0), restored.lastTime)
+}
+
+func TestLastCheckpointKeepsOnlyNewest(t *testing.T) {
+	dir := t.TempDir()
+	states := newFingerprintSeriesMap()
+
+	require.NoError(t, checkpointSeriesMapAndHeads(dir, 1, states))
+	require.NoError(t, checkpointSeriesMapAndHeads(dir, 2, states))
+
+	_, walSegment, ok, err := lastCheckpoint(dir)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, 2, walSegment)
+}
@@ -0,0 +1,150 @@
+package ingester
+
+import (
+	"flag"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/cortex/pkg/prom1/storage/local/chunk"
+)
+
+const (
+	opPin   = "pin"
+	opUnpin = "unpin"
+	opEvict = "evict"
+	opLoad  = "load"
+)
+
+var (
+	memoryChunks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_ingester_memory_chunks",
+		Help: "The total number of chunks currently held in memory.",
+	})
+	chunkOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_ingester_chunk_ops_total",
+		Help: "The total number of chunk operations, by op.",
+	}, []string{"op"})
+	evictedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_evicted_chunks_total",
+		Help: "The total number of chunks evicted from memory under pressure.",
+	})
+
+	residentChunkBytes int64 // Accessed via sync/atomic.
+)
+
+func init() {
+	prometheus.MustRegister(memoryChunks)
+	prometheus.MustRegister(chunkOps)
+	prometheus.MustRegister(evictedChunks)
+}
+
+func addResidentBytes(c chunk.Chunk) {
+	atomic.AddInt64(&residentChunkBytes, int64(c.Size()))
+}
+
+func subResidentBytes(c chunk.Chunk) {
+	atomic.AddInt64(&residentChunkBytes, -int64(c.Size()))
+}
+
+// ChunkLoader re-fetches an evicted chunk's bytes from the chunk store, for
+// the rare query that touches a chunk an evictor has already dropped.
+type ChunkLoader interface {
+	LoadChunk(from, through model.Time) (chunk.Chunk, error)
+}
+
+// EvictionConfig configures the background chunk evictor.
+type EvictionConfig struct {
+	HighWaterMarkBytes int64
+	LowWaterMarkBytes  int64
+	CheckInterval      time.Duration
+}
+
+// RegisterFlags adds the flags required to configure this flag set.
+func (cfg *EvictionConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Int64Var(&cfg.HighWaterMarkBytes, "ingester.chunk-eviction-high-water-mark-bytes", 0, "Start evicting persisted chunks once resident chunk bytes exceed this. 0 disables eviction.")
+	f.Int64Var(&cfg.LowWaterMarkBytes, "ingester.chunk-eviction-low-water-mark-bytes", 0, "Stop evicting once resident chunk bytes fall back to this.")
+	f.DurationVar(&cfg.CheckInterval, "ingester.chunk-eviction-check-interval", 15*time.Second, "How often to check resident chunk bytes against the high water mark.")
+}
+
+// evictor periodically walks every series' main-stream chunks (chunkDescs),
+// across every user, in LRU order (by desc.LastUpdate) and evicts non-head,
+// already-flushed chunks whose refcount is zero until resident memory falls
+// back under the low water mark. Out-of-order chunks (oooChunkDescs) are not
+// evicted.
+type evictor struct {
+	cfg       EvictionConfig
+	allStates func() []*fingerprintSeriesMap
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newEvictor(cfg EvictionConfig, allStates func() []*fingerprintSeriesMap) *evictor {
+	return &evictor{
+		cfg:       cfg,
+		allStates: allStates,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// run evicts on cfg.CheckInterval until stop is called. It is a no-op if no
+// high water mark was configured.
+func (e *evictor) run() {
+	defer close(e.done)
+	if e.cfg.HighWaterMarkBytes <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.runOnce()
+		case <-e.quit:
+			return
+		}
+	}
+}
+
+func (e *evictor) stop() {
+	close(e.quit)
+	<-e.done
+}
+
+func (e *evictor) runOnce() {
+	if atomic.LoadInt64(&residentChunkBytes) <= e.cfg.HighWaterMarkBytes {
+		return
+	}
+
+	var candidates []*desc
+	for _, states := range e.allStates() {
+		states.forEach(func(_ model.Fingerprint, s *memorySeries) bool {
+			if len(s.chunkDescs) == 0 {
+				return true
+			}
+			head := s.head()
+			for _, d := range s.chunkDescs {
+				if d != head {
+					candidates = append(candidates, d)
+				}
+			}
+			return true
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastUpdate.Before(candidates[j].LastUpdate)
+	})
+
+	for _, d := range candidates {
+		if atomic.LoadInt64(&residentChunkBytes) <= e.cfg.LowWaterMarkBytes {
+			return
+		}
+		d.evict()
+	}
+}
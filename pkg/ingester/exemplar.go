@@ -0,0 +1,111 @@
+package ingester
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+var (
+	exemplarsAppended = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_exemplars_appended_total",
+		Help: "The total number of exemplars appended to all series.",
+	})
+	exemplarsInStorage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_ingester_exemplars_in_storage",
+		Help: "The current number of exemplars held in in-memory series.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(exemplarsAppended)
+	prometheus.MustRegister(exemplarsInStorage)
+}
+
+// exemplar is a single exemplar observation attached to a sample.
+type exemplar struct {
+	labels    labels.Labels
+	value     model.SampleValue
+	timestamp model.Time
+}
+
+// exemplarBuffer is a fixed-size ring buffer holding the most recent
+// exemplars seen for a single series. Once full, appending overwrites the
+// oldest entry. A zero-size buffer silently discards everything added to it,
+// so series with exemplars disabled can share the same code path.
+type exemplarBuffer struct {
+	mtx  sync.Mutex
+	buf  []exemplar
+	next int
+	size int
+}
+
+// newExemplarBuffer returns a buffer that retains at most maxExemplars
+// entries.
+func newExemplarBuffer(maxExemplars int) *exemplarBuffer {
+	return &exemplarBuffer{
+		buf: make([]exemplar, maxExemplars),
+	}
+}
+
+// add inserts e into the buffer, evicting the oldest entry if the buffer is
+// already full.
+func (b *exemplarBuffer) add(e exemplar) {
+	if len(b.buf) == 0 {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.size < len(b.buf) {
+		b.size++
+		exemplarsInStorage.Inc()
+	}
+	b.buf[b.next] = e
+	b.next = (b.next + 1) % len(b.buf)
+	exemplarsAppended.Inc()
+}
+
+// forRange returns the buffered exemplars whose timestamp falls within
+// [from, through] and whose labels match every matcher in matchers, oldest
+// first.
+func (b *exemplarBuffer) forRange(from, through model.Time, matchers []*labels.Matcher) []exemplar {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var result []exemplar
+	for i := 0; i < b.size; i++ {
+		e := b.buf[(b.next-b.size+i+len(b.buf))%len(b.buf)]
+		if e.timestamp < from || e.timestamp > through {
+			continue
+		}
+		if exemplarMatches(e, matchers) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// clear drops every buffered exemplar, e.g. once the owning series has been
+// archived out of memory and nothing can serve them anymore.
+func (b *exemplarBuffer) clear() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.size > 0 {
+		exemplarsInStorage.Sub(float64(b.size))
+	}
+	b.next = 0
+	b.size = 0
+}
+
+func exemplarMatches(e exemplar, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(e.labels.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
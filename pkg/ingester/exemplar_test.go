@@ -0,0 +1,71 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+)
+
+func TestExemplarBufferAddOverwritesOldest(t *testing.T) {
+	b := newExemplarBuffer(2)
+
+	b.add(exemplar{timestamp: 1})
+	b.add(exemplar{timestamp: 2})
+	b.add(exemplar{timestamp: 3})
+
+	got := b.forRange(model.Earliest, model.Latest, nil)
+	require.Len(t, got, 2)
+	assert.Equal(t, model.Time(2), got[0].timestamp)
+	assert.Equal(t, model.Time(3), got[1].timestamp)
+}
+
+func TestExemplarBufferZeroSizeDiscardsEverything(t *testing.T) {
+	b := newExemplarBuffer(0)
+	b.add(exemplar{timestamp: 1})
+	assert.Empty(t, b.forRange(model.Earliest, model.Latest, nil))
+}
+
+func TestExemplarBufferForRangeFiltersByTimeAndMatchers(t *testing.T) {
+	b := newExemplarBuffer(4)
+	b.add(exemplar{timestamp: 1, labels: labels.FromStrings("foo", "bar")})
+	b.add(exemplar{timestamp: 5, labels: labels.FromStrings("foo", "baz")})
+	b.add(exemplar{timestamp: 10, labels: labels.FromStrings("foo", "bar")})
+
+	matcher, err := labels.NewMatcher(labels.MatchEqual, "foo", "bar")
+	require.NoError(t, err)
+
+	got := b.forRange(0, 6, []*labels.Matcher{matcher})
+	require.Len(t, got, 1)
+	assert.Equal(t, model.Time(1), got[0].timestamp)
+}
+
+func TestExemplarBufferClear(t *testing.T) {
+	b := newExemplarBuffer(4)
+	b.add(exemplar{timestamp: 1})
+	b.add(exemplar{timestamp: 2})
+
+	b.clear()
+
+	assert.Empty(t, b.forRange(model.Earliest, model.Latest, nil))
+
+	// The buffer is reusable after being cleared.
+	b.add(exemplar{timestamp: 3})
+	got := b.forRange(model.Earliest, model.Latest, nil)
+	require.Len(t, got, 1)
+	assert.Equal(t, model.Time(3), got[0].timestamp)
+}
+
+func TestMemorySeriesAddExemplarAndClearEmptiesBuffer(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 2, 0)
+
+	s.addExemplar(exemplar{timestamp: 1})
+	s.addExemplar(exemplar{timestamp: 2})
+	require.Len(t, s.exemplarsForRange(model.Earliest, model.Latest, nil), 2)
+
+	s.exemplars.clear()
+	assert.Empty(t, s.exemplarsForRange(model.Earliest, model.Latest, nil))
+}
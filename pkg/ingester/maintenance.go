@@ -0,0 +1,259 @@
+package ingester
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/user"
+	storechunk "github.com/weaveworks/cortex/pkg/chunk"
+)
+
+var (
+	memorySeriesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cortex_ingester_memory_series",
+		Help: "The current number of series held in memory.",
+	})
+	seriesArchivedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_series_archived_total",
+		Help: "The total number of series removed from memory for being idle.",
+	})
+	maintenanceDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "cortex_ingester_series_maintenance_duration_seconds",
+		Help: "Time spent running a single maintenance pass over in-memory series.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(memorySeriesGauge)
+	prometheus.MustRegister(seriesArchivedTotal)
+	prometheus.MustRegister(maintenanceDuration)
+}
+
+// MaintenanceConfig configures the stale-series archival loop.
+type MaintenanceConfig struct {
+	Interval         time.Duration
+	IdleTimeout      time.Duration
+	MaxVisitsPerTick int
+}
+
+// RegisterFlags adds the flags required to configure this flag set.
+func (cfg *MaintenanceConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Interval, "ingester.maintenance-interval", time.Minute, "How often to run the stale-series maintenance pass.")
+	f.DurationVar(&cfg.IdleTimeout, "ingester.series-idle-timeout", 20*time.Minute, "Archive (flush and drop from memory) series that haven't been appended to for this long. 0 disables archival.")
+	f.IntVar(&cfg.MaxVisitsPerTick, "ingester.maintenance-max-series-per-tick", 5000, "Visit no more than this many series per maintenance-interval tick, to bound the work done in a single pass.")
+}
+
+// chunkStore is the subset of the chunk store the maintenance loop needs to
+// flush an archived series' chunks.
+type chunkStore interface {
+	Put(ctx context.Context, chunks []storechunk.Chunk) error
+}
+
+// userSeries pairs a user's in-memory series map with the userID needed to
+// scope chunk-store writes made on its behalf.
+type userSeries struct {
+	userID string
+	states *fingerprintSeriesMap
+}
+
+// delete removes fp from the map. Appends for fp after this are expected to
+// transparently recreate the series.
+func (f *fingerprintSeriesMap) delete(fp model.Fingerprint) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	delete(f.m, fp)
+}
+
+// maintenanceLoop periodically visits every in-memory series and archives
+// (flushes and removes) any whose head hasn't been appended to in
+// cfg.IdleTimeout, bounding ingester memory under high series churn. It is
+// modeled on Prometheus 1.x's memorySeriesStorage.loop.
+type maintenanceLoop struct {
+	cfg   MaintenanceConfig
+	users func() []userSeries
+	store chunkStore
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newMaintenanceLoop(cfg MaintenanceConfig, users func() []userSeries, store chunkStore) *maintenanceLoop {
+	return &maintenanceLoop{
+		cfg:   cfg,
+		users: users,
+		store: store,
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func (m *maintenanceLoop) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.runOnce(context.Background())
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *maintenanceLoop) stop() {
+	close(m.quit)
+	<-m.done
+}
+
+func (m *maintenanceLoop) runOnce(ctx context.Context) {
+	start := time.Now()
+	defer func() { maintenanceDuration.Observe(time.Since(start).Seconds()) }()
+
+	users := m.users()
+
+	var total int
+	for _, us := range users {
+		total += us.states.len()
+	}
+	memorySeriesGauge.Set(float64(total))
+
+	archiving := m.cfg.IdleTimeout > 0
+	var cutoff model.Time
+	if archiving {
+		cutoff = model.Now().Add(-m.cfg.IdleTimeout)
+	}
+	visited := 0
+
+	for _, us := range users {
+		if visited >= m.cfg.MaxVisitsPerTick {
+			break
+		}
+
+		type idleSeries struct {
+			fp model.Fingerprint
+			s  *memorySeries
+		}
+		var idle []idleSeries
+
+		us.states.forEach(func(fp model.Fingerprint, s *memorySeries) bool {
+			if visited >= m.cfg.MaxVisitsPerTick {
+				return false
+			}
+			visited++
+
+			// Drain any samples the out-of-order window has accepted but
+			// not yet merged into oooChunkDescs, so they become visible to
+			// reads and eligible for flush instead of being lost if the
+			// series is archived before they're ever merged.
+			if err := s.mergeOOO(); err != nil {
+				log.Errorf("maintenance: failed to merge out-of-order samples for series %v for user %s: %v", fp, us.userID, err)
+			}
+
+			// Flush (but don't archive) completed, non-head chunks of this
+			// still-resident series. This is the only path that marks a
+			// chunk flushed while its series stays live, so the evictor
+			// ever has real candidates to evict under a continuously
+			// ingesting, high-churn workload instead of only ever seeing
+			// chunks belonging to already-archived series.
+			if err := m.flushCompletedChunks(ctx, us.userID, fp, s); err != nil {
+				log.Errorf("maintenance: failed to flush completed chunks for series %v for user %s: %v", fp, us.userID, err)
+			}
+
+			if !archiving || len(s.chunkDescs) == 0 || s.head().LastUpdate.After(cutoff) {
+				return true
+			}
+			idle = append(idle, idleSeries{fp, s})
+			return true
+		})
+
+		for _, is := range idle {
+			if err := m.archive(ctx, us.userID, is.fp, us.states, is.s); err != nil {
+				log.Errorf("maintenance: failed to archive series %v for user %s: %v", is.fp, us.userID, err)
+				continue
+			}
+			seriesArchivedTotal.Inc()
+		}
+	}
+}
+
+// archive finalizes s' chunks, flushes them to the store and removes fp
+// from states.
+func (m *maintenanceLoop) archive(ctx context.Context, userID string, fp model.Fingerprint, states *fingerprintSeriesMap, s *memorySeries) error {
+	s.closeHead()
+	s.closeOOOHead()
+	if err := s.mergeOOO(); err != nil {
+		return err
+	}
+
+	if err := m.store.Put(user.InjectOrgID(ctx, userID), chunksToFlush(userID, fp, s)); err != nil {
+		return err
+	}
+	states.delete(fp)
+	// The series is gone from memory, so nothing can serve its buffered
+	// exemplars anymore; drop them rather than let them dangle off an
+	// orphaned memorySeries.
+	s.exemplars.clear()
+	return nil
+}
+
+// chunksToFlush returns the chunks from s that still need to be persisted,
+// i.e. excludes anything the evictor has already flushed (and possibly
+// evicted) out from under this idle series. Each chunk is wrapped with the
+// series identity (userID, fingerprint, metric) the chunk store needs to
+// ever retrieve what it persisted.
+func chunksToFlush(userID string, fp model.Fingerprint, s *memorySeries) []storechunk.Chunk {
+	chunks := make([]storechunk.Chunk, 0, len(s.chunkDescs)+len(s.oooChunkDescs))
+	chunks = appendUnflushed(chunks, s.chunkDescs, userID, fp, s.metric)
+	chunks = appendUnflushed(chunks, s.oooChunkDescs, userID, fp, s.metric)
+	return chunks
+}
+
+func appendUnflushed(chunks []storechunk.Chunk, descs []*desc, userID string, fp model.Fingerprint, metric model.Metric) []storechunk.Chunk {
+	for _, d := range descs {
+		if d.flushed || d.isEvicted() {
+			continue
+		}
+		chunks = append(chunks, storechunk.NewChunk(userID, fp, metric, d.C, d.FirstTime, d.LastTime))
+		d.markFlushed()
+	}
+	return chunks
+}
+
+// flushCompletedChunks persists s' already-closed, not-yet-flushed chunks
+// while leaving s itself resident, so a continuously-ingesting series gets
+// its old chunks marked flushed (and therefore evictable) long before it
+// would ever go idle long enough to be archived.
+func (m *maintenanceLoop) flushCompletedChunks(ctx context.Context, userID string, fp model.Fingerprint, s *memorySeries) error {
+	chunks := completedUnflushed(s.chunkDescs, userID, fp, s.metric)
+	chunks = append(chunks, completedUnflushed(s.oooChunkDescs, userID, fp, s.metric)...)
+	if len(chunks) == 0 {
+		return nil
+	}
+	return m.store.Put(user.InjectOrgID(ctx, userID), chunks)
+}
+
+// completedUnflushed returns store-ready chunks for every desc in descs
+// except the last (the head, which is still being appended to and must
+// stay resident), skipping anything already flushed or evicted and marking
+// what it does collect as flushed.
+func completedUnflushed(descs []*desc, userID string, fp model.Fingerprint, metric model.Metric) []storechunk.Chunk {
+	if len(descs) <= 1 {
+		return nil
+	}
+	var chunks []storechunk.Chunk
+	for _, d := range descs[:len(descs)-1] {
+		if d.flushed || d.isEvicted() {
+			continue
+		}
+		chunks = append(chunks, storechunk.NewChunk(userID, fp, metric, d.C, d.FirstTime, d.LastTime))
+		d.markFlushed()
+	}
+	return chunks
+}
@@ -0,0 +1,112 @@
+package ingester
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/common/model"
+	"github.com/weaveworks/common/user"
+	storechunk "github.com/weaveworks/cortex/pkg/chunk"
+)
+
+type fakeStore struct {
+	puts [][]storechunk.Chunk
+}
+
+func (f *fakeStore) Put(ctx context.Context, chunks []storechunk.Chunk) error {
+	f.puts = append(f.puts, chunks)
+	return nil
+}
+
+func TestChunksToFlushSkipsAlreadyFlushedAndEvicted(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 0)
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 1, Value: 1}))
+	s.closeHead()
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 2, Value: 2}))
+	s.closeHead()
+
+	require.Len(t, s.chunkDescs, 2)
+	alreadyFlushed, notYetFlushed := s.chunkDescs[0], s.chunkDescs[1]
+	alreadyFlushed.markFlushed()
+	require.True(t, alreadyFlushed.evict())
+
+	chunks := chunksToFlush("user", 1, s)
+	require.Len(t, chunks, 1)
+	assert.Equal(t, notYetFlushed.C, chunks[0].Data)
+	assert.Equal(t, "user", chunks[0].UserID)
+	assert.True(t, notYetFlushed.flushed)
+}
+
+func TestMaintenanceLoopArchivesIdleSeriesAndClearsExemplars(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 4, 0)
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 1, Value: 1}))
+	s.addExemplar(exemplar{timestamp: 1})
+
+	states := newFingerprintSeriesMap()
+	fp := model.Fingerprint(1)
+	states.set(fp, s)
+
+	store := &fakeStore{}
+	m := newMaintenanceLoop(MaintenanceConfig{IdleTimeout: time.Minute, MaxVisitsPerTick: 10}, func() []userSeries {
+		return []userSeries{{userID: "user", states: states}}
+	}, store)
+
+	require.NoError(t, m.archive(context.Background(), "user", fp, states, s))
+
+	_, ok := states.get(fp)
+	assert.False(t, ok)
+	assert.Len(t, store.puts, 1)
+	assert.Len(t, store.puts[0], 1)
+	assert.Empty(t, s.exemplarsForRange(model.Earliest, model.Latest, nil))
+}
+
+func TestMaintenanceLoopRunOnceFlushesCompletedChunksOfLiveSeries(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 0)
+	require.NoError(t, s.add(model.SamplePair{Timestamp: model.Now() - 2, Value: 1}))
+	s.closeHead()
+	require.NoError(t, s.add(model.SamplePair{Timestamp: model.Now(), Value: 2}))
+	require.Len(t, s.chunkDescs, 2)
+	tail, head := s.chunkDescs[0], s.chunkDescs[1]
+
+	states := newFingerprintSeriesMap()
+	states.set(1, s)
+
+	store := &fakeStore{}
+	m := newMaintenanceLoop(MaintenanceConfig{IdleTimeout: time.Hour, MaxVisitsPerTick: 10}, func() []userSeries {
+		return []userSeries{{userID: "user", states: states}}
+	}, store)
+
+	m.runOnce(user.InjectOrgID(context.Background(), "user"))
+
+	// The series is still live (recently appended to), but its completed,
+	// non-head chunk was flushed so the evictor can eventually pick it up.
+	_, ok := states.get(1)
+	assert.True(t, ok)
+	assert.True(t, tail.flushed)
+	assert.False(t, head.flushed)
+	require.Len(t, store.puts, 1)
+	require.Len(t, store.puts[0], 1)
+}
+
+func TestMaintenanceLoopRunOnceSkipsRecentlyUpdatedSeries(t *testing.T) {
+	fresh := newMemorySeries(model.Metric{model.MetricNameLabel: "fresh"}, 0, 0)
+	require.NoError(t, fresh.add(model.SamplePair{Timestamp: model.Now(), Value: 1}))
+
+	states := newFingerprintSeriesMap()
+	states.set(1, fresh)
+
+	store := &fakeStore{}
+	m := newMaintenanceLoop(MaintenanceConfig{IdleTimeout: time.Hour, MaxVisitsPerTick: 10}, func() []userSeries {
+		return []userSeries{{userID: "user", states: states}}
+	}, store)
+
+	m.runOnce(user.InjectOrgID(context.Background(), "user"))
+
+	_, ok := states.get(1)
+	assert.True(t, ok, "series updated within the idle timeout must not be archived")
+	assert.Empty(t, store.puts)
+}
@@ -0,0 +1,90 @@
+package ingester
+
+import (
+	"flag"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	oooReasonTooOld    = "too-old"
+	oooReasonDuplicate = "duplicate"
+)
+
+// OutOfOrderConfig configures how far behind a series' last sample an
+// incoming sample may be timestamped and still be accepted.
+type OutOfOrderConfig struct {
+	Window time.Duration
+}
+
+// RegisterFlags adds the flags required to configure this flag set.
+func (cfg *OutOfOrderConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Window, "ingester.out-of-order-window", 0, "Accept samples timestamped up to this long before a series' last sample, instead of rejecting them as out of order. 0 disables out-of-order acceptance.")
+}
+
+var (
+	oooSamplesAppended = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cortex_ingester_ooo_samples_appended_total",
+		Help: "The total number of out-of-order samples accepted into the scratch buffer.",
+	})
+	oooSamplesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cortex_ingester_ooo_samples_rejected_total",
+		Help: "The total number of samples rejected for being out of order, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(oooSamplesAppended)
+	prometheus.MustRegister(oooSamplesRejected)
+}
+
+// oooBuffer holds a series' accepted-but-not-yet-merged out-of-order
+// samples, kept sorted by timestamp so mergeOOO only has to walk it once.
+type oooBuffer struct {
+	samples []model.SamplePair
+}
+
+// add inserts v into the buffer in timestamp order. It returns false
+// without modifying the buffer if a sample with the same timestamp is
+// already buffered.
+func (b *oooBuffer) add(v model.SamplePair) bool {
+	i := sort.Search(len(b.samples), func(i int) bool {
+		return !b.samples[i].Timestamp.Before(v.Timestamp)
+	})
+	if i < len(b.samples) && b.samples[i].Timestamp == v.Timestamp {
+		return false
+	}
+	b.samples = append(b.samples, model.SamplePair{})
+	copy(b.samples[i+1:], b.samples[i:])
+	b.samples[i] = v
+	return true
+}
+
+// drain removes and returns every buffered sample, in timestamp order.
+func (b *oooBuffer) drain() []model.SamplePair {
+	samples := b.samples
+	b.samples = nil
+	return samples
+}
+
+// mergeSamplePairs merges two timestamp-sorted slices of sample pairs into
+// a single timestamp-sorted slice.
+func mergeSamplePairs(a, b []model.SamplePair) []model.SamplePair {
+	merged := make([]model.SamplePair, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].Timestamp <= b[j].Timestamp {
+			merged = append(merged, a[i])
+			i++
+		} else {
+			merged = append(merged, b[j])
+			j++
+		}
+	}
+	merged = append(merged, a[i:]...)
+	merged = append(merged, b[j:]...)
+	return merged
+}
@@ -0,0 +1,78 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestOOOBufferAddKeepsTimestampOrder(t *testing.T) {
+	var b oooBuffer
+
+	assert.True(t, b.add(model.SamplePair{Timestamp: 10, Value: 1}))
+	assert.True(t, b.add(model.SamplePair{Timestamp: 5, Value: 2}))
+	assert.True(t, b.add(model.SamplePair{Timestamp: 7, Value: 3}))
+
+	// A duplicate timestamp is rejected rather than overwriting the
+	// existing sample.
+	assert.False(t, b.add(model.SamplePair{Timestamp: 7, Value: 4}))
+
+	want := []model.SamplePair{
+		{Timestamp: 5, Value: 2},
+		{Timestamp: 7, Value: 3},
+		{Timestamp: 10, Value: 1},
+	}
+	assert.Equal(t, want, b.drain())
+
+	// drain empties the buffer.
+	assert.Empty(t, b.drain())
+}
+
+func TestMergeSamplePairs(t *testing.T) {
+	a := []model.SamplePair{{Timestamp: 1}, {Timestamp: 3}, {Timestamp: 5}}
+	b := []model.SamplePair{{Timestamp: 2}, {Timestamp: 4}}
+
+	merged := mergeSamplePairs(a, b)
+	var got []model.Time
+	for _, v := range merged {
+		got = append(got, v.Timestamp)
+	}
+	assert.Equal(t, []model.Time{1, 2, 3, 4, 5}, got)
+}
+
+func TestMemorySeriesAcceptsOutOfOrderWithinWindow(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 10*time.Millisecond)
+
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 100, Value: 1}))
+
+	// Within the OOO window: accepted into the scratch buffer, not rejected.
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 95, Value: 2}))
+
+	// Older than the window: rejected as out of order.
+	err := s.add(model.SamplePair{Timestamp: 80, Value: 3})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "out of order")
+
+	require.NoError(t, s.mergeOOO())
+	require.Len(t, s.oooChunkDescs, 1)
+
+	values, err := valuesForRange(s.oooChunkDescs, model.Earliest, model.Latest, nil)
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+	assert.Equal(t, model.Time(95), values[0].Timestamp)
+}
+
+func TestMemorySeriesRejectsOutOfOrderWithoutWindow(t *testing.T) {
+	s := newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 0)
+
+	require.NoError(t, s.add(model.SamplePair{Timestamp: 100, Value: 1}))
+
+	err := s.add(model.SamplePair{Timestamp: 99, Value: 2})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "out of order")
+	assert.Empty(t, s.ooo.drain())
+}
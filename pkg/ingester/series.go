@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/weaveworks/common/httpgrpc"
 	"github.com/weaveworks/cortex/pkg/prom1/storage/local/chunk"
 	"github.com/weaveworks/cortex/pkg/prom1/storage/metric"
@@ -39,14 +42,38 @@ type memorySeries struct {
 	lastSampleValueSet bool
 	lastTime           model.Time
 	lastSampleValue    model.SampleValue
+
+	// Ring buffer of the most recent exemplars seen for this series. Never
+	// nil, but may have zero capacity if exemplar storage is disabled.
+	exemplars *exemplarBuffer
+
+	// How far back before lastTime an out-of-order sample is still
+	// accepted. Zero preserves the historic strict-monotonic behavior.
+	oooWindow time.Duration
+	// Scratch buffer of accepted-but-not-yet-merged out-of-order samples.
+	ooo *oooBuffer
+	// A chunk stream separate from chunkDescs that out-of-order samples are
+	// merged into, so it can be flushed independently. The evictor does not
+	// evict these chunks, and they are flushed to the chunk store the same
+	// way as main-stream chunks, with nothing marking them as out-of-order.
+	oooChunkDescs []*desc
+	// Whether the current OOO head chunk has already been finished, mirrors
+	// headChunkClosed for the main chunk stream.
+	oooHeadClosed bool
 }
 
 // newMemorySeries returns a pointer to a newly allocated memorySeries for the
-// given metric.
-func newMemorySeries(m model.Metric) *memorySeries {
+// given metric. maxExemplars bounds the number of exemplars retained per
+// series; 0 disables exemplar storage for the series. oooWindow bounds how
+// far behind lastTime a sample may land and still be accepted into the
+// out-of-order scratch buffer; 0 preserves strict timestamp monotonicity.
+func newMemorySeries(m model.Metric, maxExemplars int, oooWindow time.Duration) *memorySeries {
 	return &memorySeries{
-		metric:   m,
-		lastTime: model.Earliest,
+		metric:    m,
+		lastTime:  model.Earliest,
+		exemplars: newExemplarBuffer(maxExemplars),
+		oooWindow: oooWindow,
+		ooo:       &oooBuffer{},
 	}
 }
 
@@ -69,7 +96,17 @@ func (s *memorySeries) add(v model.SamplePair) error {
 		return httpgrpc.Errorf(http.StatusBadRequest, "sample with repeated timestamp but different value for series %v; last value: %v, incoming value: %v", s.metric, s.lastSampleValue, v.Value)
 	}
 	if v.Timestamp < s.lastTime {
+		if s.oooWindow > 0 && !v.Timestamp.Before(s.lastTime.Add(-s.oooWindow)) {
+			if !s.ooo.add(v) {
+				validation.DiscardedSamples.WithLabelValues(duplicateSample).Inc()
+				oooSamplesRejected.WithLabelValues(oooReasonDuplicate).Inc()
+				return httpgrpc.Errorf(http.StatusBadRequest, "out-of-order sample with repeated timestamp for series %v; incoming timestamp: %v", s.metric, v.Timestamp)
+			}
+			oooSamplesAppended.Inc()
+			return nil
+		}
 		validation.DiscardedSamples.WithLabelValues(outOfOrderTimestamp).Inc()
+		oooSamplesRejected.WithLabelValues(oooReasonTooOld).Inc()
 		return httpgrpc.Errorf(http.StatusBadRequest, "sample timestamp out of order for series %v; last timestamp: %v, incoming timestamp: %v", s.metric, s.lastTime, v.Timestamp) // Caused by the caller.
 	}
 
@@ -113,6 +150,60 @@ func (s *memorySeries) closeHead() {
 	s.headChunkClosed = true
 }
 
+// closeOOOHead finalizes the current out-of-order chunk so it is eligible
+// for flushing, mirroring closeHead for the main chunk stream.
+func (s *memorySeries) closeOOOHead() {
+	s.oooHeadClosed = true
+}
+
+// mergeOOO drains the out-of-order scratch buffer, in timestamp order, into
+// the OOO chunk stream. It is called periodically rather than on every
+// append so that a burst of reordered samples doesn't create one tiny chunk
+// per sample. The caller must have locked the fingerprint of the series.
+func (s *memorySeries) mergeOOO() error {
+	for _, v := range s.ooo.drain() {
+		if len(s.oooChunkDescs) == 0 || s.oooHeadClosed {
+			s.oooChunkDescs = append(s.oooChunkDescs, newDesc(chunk.New(), v.Timestamp, v.Timestamp))
+			s.oooHeadClosed = false
+			createdChunks.Inc()
+		}
+
+		tail := s.oooChunkDescs[len(s.oooChunkDescs)-1]
+		chunks, err := tail.add(v)
+		if err != nil {
+			return err
+		}
+
+		if len(chunks) == 1 {
+			tail.C = chunks[0]
+			continue
+		}
+		s.oooChunkDescs = s.oooChunkDescs[:len(s.oooChunkDescs)-1]
+		for _, c := range chunks {
+			lastTime, err := c.NewIterator().LastTimestamp()
+			if err != nil {
+				return err
+			}
+			s.oooChunkDescs = append(s.oooChunkDescs, newDesc(c, c.FirstTime(), lastTime))
+			createdChunks.Inc()
+		}
+	}
+	return nil
+}
+
+// addExemplar appends an exemplar observation to the series, discarding the
+// oldest stored exemplar if the per-series buffer is already full. The
+// caller must have locked the fingerprint of the series.
+func (s *memorySeries) addExemplar(e exemplar) {
+	s.exemplars.add(e)
+}
+
+// exemplarsForRange returns the series' exemplars whose timestamp falls
+// within [from, through] and whose labels match every matcher in matchers.
+func (s *memorySeries) exemplarsForRange(from, through model.Time, matchers []*labels.Matcher) []exemplar {
+	return s.exemplars.forRange(from, through, matchers)
+}
+
 // firstTime returns the earliest known time for the series. The caller must have
 // locked the fingerprint of the memorySeries. This method will panic if this
 // series has no chunk descriptors.
@@ -127,19 +218,44 @@ func (s *memorySeries) head() *desc {
 	return s.chunkDescs[len(s.chunkDescs)-1]
 }
 
-func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.SamplePair, error) {
+func (s *memorySeries) samplesForRange(from, through model.Time, loader ChunkLoader) ([]model.SamplePair, error) {
+	values, err := valuesForRange(s.chunkDescs, from, through, loader)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.oooChunkDescs) == 0 {
+		return values, nil
+	}
+	oooValues, err := valuesForRange(s.oooChunkDescs, from, through, loader)
+	if err != nil {
+		return nil, err
+	}
+	if len(oooValues) == 0 {
+		return values, nil
+	}
+	return mergeSamplePairs(values, oooValues), nil
+}
+
+// valuesForRange returns the sample pairs in [from, through] held by descs,
+// which must be sorted by start time with non-overlapping ranges. Each desc
+// visited is pinned for the duration of the read and, if it has been
+// evicted, reloaded from the chunk store via loader.
+func valuesForRange(descs []*desc, from, through model.Time, loader ChunkLoader) ([]model.SamplePair, error) {
+	if len(descs) == 0 {
+		return nil, nil
+	}
 	// Find first chunk with start time after "from".
-	fromIdx := sort.Search(len(s.chunkDescs), func(i int) bool {
-		return s.chunkDescs[i].FirstTime.After(from)
+	fromIdx := sort.Search(len(descs), func(i int) bool {
+		return descs[i].FirstTime.After(from)
 	})
 	// Find first chunk with start time after "through".
-	throughIdx := sort.Search(len(s.chunkDescs), func(i int) bool {
-		return s.chunkDescs[i].FirstTime.After(through)
+	throughIdx := sort.Search(len(descs), func(i int) bool {
+		return descs[i].FirstTime.After(through)
 	})
-	if fromIdx == len(s.chunkDescs) {
+	if fromIdx == len(descs) {
 		// Even the last chunk starts before "from". Find out if the
 		// series ends before "from" and we don't need to do anything.
-		lt := s.chunkDescs[len(s.chunkDescs)-1].LastTime
+		lt := descs[len(descs)-1].LastTime
 		if lt.Before(from) {
 			return nil, nil
 		}
@@ -147,7 +263,7 @@ func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.Sample
 	if fromIdx > 0 {
 		fromIdx--
 	}
-	if throughIdx == len(s.chunkDescs) {
+	if throughIdx == len(descs) {
 		throughIdx--
 	}
 	var values []model.SamplePair
@@ -156,8 +272,10 @@ func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.Sample
 		NewestInclusive: through,
 	}
 	for idx := fromIdx; idx <= throughIdx; idx++ {
-		cd := s.chunkDescs[idx]
-		chValues, err := chunk.RangeValues(cd.C.NewIterator(), in)
+		cd := descs[idx]
+		cd.pin()
+		chValues, err := valuesFromDesc(cd, loader, in)
+		cd.unpin()
 		if err != nil {
 			return nil, err
 		}
@@ -166,6 +284,15 @@ func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.Sample
 	return values, nil
 }
 
+func valuesFromDesc(cd *desc, loader ChunkLoader, in metric.Interval) ([]model.SamplePair, error) {
+	if cd.isEvicted() {
+		if err := cd.load(loader); err != nil {
+			return nil, err
+		}
+	}
+	return chunk.RangeValues(cd.C.NewIterator(), in)
+}
+
 func (s *memorySeries) setChunks(descs []*desc) error {
 	if len(s.chunkDescs) != 0 {
 		return fmt.Errorf("series already has chunks")
@@ -183,9 +310,15 @@ type desc struct {
 	FirstTime  model.Time  // Timestamp of first sample. Populated at creation. Immutable.
 	LastTime   model.Time  // Timestamp of last sample. Populated at creation & on append.
 	LastUpdate model.Time  // This server's local time on last change
+
+	mtx      sync.Mutex // Guards refCount, flushed and C against a concurrent pin/evict race.
+	refCount int32      // 0 means nothing is currently reading C.
+	flushed  bool       // Whether C has been persisted to the chunk store. Only a flushed, unpinned chunk may be evicted.
 }
 
 func newDesc(c chunk.Chunk, firstTime model.Time, lastTime model.Time) *desc {
+	memoryChunks.Inc()
+	addResidentBytes(c)
 	return &desc{
 		C:          c,
 		FirstTime:  firstTime,
@@ -194,6 +327,93 @@ func newDesc(c chunk.Chunk, firstTime model.Time, lastTime model.Time) *desc {
 	}
 }
 
+// markFlushed records that C has been persisted to the chunk store, making
+// the desc eligible for eviction once unpinned.
+func (d *desc) markFlushed() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.flushed = true
+}
+
+// pin increments the desc's reference count, keeping its chunk resident
+// (and therefore ineligible for eviction) while held. The caller must have
+// locked the fingerprint of the owning series.
+func (d *desc) pin() {
+	d.mtx.Lock()
+	d.refCount++
+	d.mtx.Unlock()
+	chunkOps.WithLabelValues(opPin).Inc()
+}
+
+// unpin decrements the desc's reference count. It must be called exactly
+// once for every pin.
+func (d *desc) unpin() {
+	d.mtx.Lock()
+	d.refCount--
+	negative := d.refCount < 0
+	d.mtx.Unlock()
+	if negative {
+		panic("ingester: chunk unpinned more times than it was pinned")
+	}
+	chunkOps.WithLabelValues(opUnpin).Inc()
+}
+
+// isEvicted reports whether C has been evicted and must be reloaded before
+// use.
+func (d *desc) isEvicted() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.C == nil
+}
+
+// evict drops the desc's reference to its chunk so it can be garbage
+// collected. It is a no-op returning false unless the chunk has already
+// been flushed to the chunk store and nothing currently holds a pin on it.
+// The flushed/refCount/C check-and-clear happens under d.mtx, the same lock
+// pin and unpin take, so a pin can never observe refCount back at zero with
+// C already cleared out from under it.
+func (d *desc) evict() bool {
+	d.mtx.Lock()
+	if !d.flushed || d.refCount > 0 || d.C == nil {
+		d.mtx.Unlock()
+		return false
+	}
+	c := d.C
+	d.C = nil
+	d.mtx.Unlock()
+
+	subResidentBytes(c)
+	memoryChunks.Dec()
+	evictedChunks.Inc()
+	chunkOps.WithLabelValues(opEvict).Inc()
+	return true
+}
+
+// load lazily re-fetches an evicted chunk from the chunk store. It is a
+// no-op if the chunk is already resident. The caller must hold a pin on d.
+func (d *desc) load(loader ChunkLoader) error {
+	d.mtx.Lock()
+	if d.C != nil {
+		d.mtx.Unlock()
+		return nil
+	}
+	d.mtx.Unlock()
+
+	c, err := loader.LoadChunk(d.FirstTime, d.LastTime)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	d.C = c
+	d.mtx.Unlock()
+
+	memoryChunks.Inc()
+	addResidentBytes(c)
+	chunkOps.WithLabelValues(opLoad).Inc()
+	return nil
+}
+
 // Add adds a sample pair to the underlying chunk. For safe concurrent access,
 // The chunk must be pinned, and the caller must have locked the fingerprint of
 // the series.
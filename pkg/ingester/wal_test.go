@@ -0,0 +1,113 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestWALLogAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	cfg := WALConfig{Dir: dir}
+
+	wal, err := newWAL(cfg)
+	require.NoError(t, err)
+
+	m := model.Metric{model.MetricNameLabel: "testmetric"}
+	fp := model.Fingerprint(1)
+
+	require.NoError(t, wal.logSeries(fp, m))
+	require.NoError(t, wal.logSamples(fp, []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}))
+	require.NoError(t, wal.stop())
+
+	states := newFingerprintSeriesMap()
+	require.NoError(t, replayWAL(dir, 0, states, SeriesDefaults{MaxExemplars: 3, OOOWindow: time.Second}))
+
+	series, ok := states.get(fp)
+	require.True(t, ok)
+	assert.Equal(t, m, series.metric)
+	assert.Equal(t, model.Time(2), series.lastTime)
+
+	values, err := valuesForRange(series.chunkDescs, model.Earliest, model.Latest, nil)
+	require.NoError(t, err)
+	require.Len(t, values, 2)
+	assert.Equal(t, model.Time(1), values[0].Timestamp)
+	assert.Equal(t, model.Time(2), values[1].Timestamp)
+
+	// Series recreated by replay keep the limits passed in, not 0.
+	assert.Equal(t, time.Second, series.oooWindow)
+	assert.Equal(t, 3, len(series.exemplars.buf))
+}
+
+func TestWALRotateStartsFreshSegmentAndTruncateRemovesOld(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := newWAL(WALConfig{Dir: dir})
+	require.NoError(t, err)
+
+	fp := model.Fingerprint(1)
+	require.NoError(t, wal.logSeries(fp, model.Metric{model.MetricNameLabel: "testmetric"}))
+
+	segments, err := walSegments(dir)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	first := segments[0]
+
+	next, err := wal.rotate()
+	require.NoError(t, err)
+	assert.Greater(t, next, first)
+
+	segments, err = walSegments(dir)
+	require.NoError(t, err)
+	assert.Len(t, segments, 2)
+
+	require.NoError(t, wal.truncate(next))
+
+	segments, err = walSegments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []int{next}, segments)
+
+	require.NoError(t, wal.stop())
+}
+
+func TestReplayWALSkipsSegmentsBeforeFromSegment(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := newWAL(WALConfig{Dir: dir})
+	require.NoError(t, err)
+
+	fp := model.Fingerprint(1)
+	m := model.Metric{model.MetricNameLabel: "testmetric"}
+	require.NoError(t, wal.logSeries(fp, m))
+	require.NoError(t, wal.logSamples(fp, []model.SamplePair{{Timestamp: 1, Value: 1}}))
+
+	fromSegment, err := wal.rotate()
+	require.NoError(t, err)
+	require.NoError(t, wal.logSamples(fp, []model.SamplePair{{Timestamp: 2, Value: 2}}))
+	require.NoError(t, wal.stop())
+
+	states := newFingerprintSeriesMap()
+	require.NoError(t, replayWAL(dir, fromSegment, states, SeriesDefaults{}))
+
+	// The series record lives in the segment before fromSegment, so replay
+	// starting at fromSegment never recreates the series at all.
+	_, ok := states.get(fp)
+	assert.False(t, ok)
+}
+
+func TestFingerprintSeriesMapForEachStopsWhenFnReturnsFalse(t *testing.T) {
+	states := newFingerprintSeriesMap()
+	for i := model.Fingerprint(0); i < 10; i++ {
+		states.set(i, newMemorySeries(model.Metric{model.MetricNameLabel: "testmetric"}, 0, 0))
+	}
+
+	visited := 0
+	states.forEach(func(_ model.Fingerprint, _ *memorySeries) bool {
+		visited++
+		return visited < 3
+	})
+
+	assert.Equal(t, 3, visited, "forEach must stop scanning as soon as fn returns false")
+}